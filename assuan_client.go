@@ -0,0 +1,180 @@
+package libkb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+//
+// A small Assuan protocol client, shared by Pinentry and GPGAgentPinentry.
+// Assuan is the line-based IPC protocol gpg-agent and pinentry speak:
+// commands go out as plain text lines, and responses come back as one
+// of:
+//
+//   OK [human text]          -- success
+//   ERR <code> <human text>  -- failure, <code> is a libgpg-error code
+//   D <percent-escaped data> -- a line of data (may repeat)
+//   # comment                -- ignored
+//
+// See https://www.gnupg.org/documentation/manuals/assuan/ for the full
+// spec; we only implement the subset pinentry and gpg-agent need.
+//
+
+// errCanceled is the libgpg-error code (GPG_ERR_CANCELED) that pinentry
+// and gpg-agent report when the user dismisses the dialog.
+const errCanceled = 83886179
+
+// PinentryCanceled is returned when the user cancels the pinentry (or
+// gpg-agent) dialog rather than supplying a passphrase.
+type PinentryCanceled struct{}
+
+func (e PinentryCanceled) Error() string {
+	return "pinentry canceled"
+}
+
+type assuanClient struct {
+	w io.Writer
+	r *bufio.Scanner
+}
+
+func newAssuanClient(w io.Writer, r io.Reader) *assuanClient {
+	return &assuanClient{w: w, r: bufio.NewScanner(r)}
+}
+
+// readLine reads one Assuan response line, transparently skipping
+// comment lines.
+func (a *assuanClient) readLine() (string, error) {
+	for {
+		if !a.r.Scan() {
+			if err := a.r.Err(); err != nil {
+				return "", err
+			}
+			return "", io.ErrUnexpectedEOF
+		}
+		line := a.r.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		return line, nil
+	}
+}
+
+// expectOK reads a single response line and fails unless it's an OK,
+// used to consume the "OK Pleased to meet you" banner a freshly
+// spawned pinentry (or freshly connected gpg-agent) sends first.
+func (a *assuanClient) expectOK() error {
+	line, err := a.readLine()
+	if err != nil {
+		return err
+	}
+	return parseAssuanStatus(line)
+}
+
+func parseAssuanStatus(line string) error {
+	switch {
+	case line == "OK" || strings.HasPrefix(line, "OK "):
+		return nil
+	case strings.HasPrefix(line, "ERR "):
+		return parseAssuanErr(line)
+	default:
+		return fmt.Errorf("unexpected assuan response: %s", line)
+	}
+}
+
+func parseAssuanErr(line string) error {
+	fields := strings.SplitN(strings.TrimPrefix(line, "ERR "), " ", 2)
+	code, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return fmt.Errorf("malformed assuan error line: %s", line)
+	}
+	if code == errCanceled {
+		return PinentryCanceled{}
+	}
+	msg := ""
+	if len(fields) > 1 {
+		msg = fields[1]
+	}
+	return fmt.Errorf("assuan error %d: %s", code, msg)
+}
+
+// send writes a single command line, unterminated by any response
+// handling -- callers that need the OK/ERR back should use command.
+func (a *assuanClient) send(cmd string) error {
+	_, err := fmt.Fprintf(a.w, "%s\n", cmd)
+	return err
+}
+
+// command sends a command line and waits for its OK/ERR response.
+func (a *assuanClient) command(cmd string) error {
+	if err := a.send(cmd); err != nil {
+		return err
+	}
+	line, err := a.readLine()
+	if err != nil {
+		return err
+	}
+	return parseAssuanStatus(line)
+}
+
+// readData reads a run of "D ..." lines terminated by OK or ERR,
+// unescaping and concatenating the data as it goes. This is how both
+// pinentry's GETPIN and gpg-agent's GET_PASSPHRASE --data return the
+// passphrase.
+func (a *assuanClient) readData() (string, error) {
+	var data strings.Builder
+	for {
+		line, err := a.readLine()
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case strings.HasPrefix(line, "D "):
+			data.WriteString(assuanUnescape(line[2:]))
+		case line == "OK" || strings.HasPrefix(line, "OK "):
+			return data.String(), nil
+		case strings.HasPrefix(line, "ERR "):
+			return "", parseAssuanErr(line)
+		default:
+			// Ignore other status lines (S, INQUIRE, COMMENT, ...).
+		}
+	}
+}
+
+// assuanEscape percent-escapes a string for use as a single-line
+// Assuan command argument (SETDESC, SETPROMPT, SETERROR, ...).
+func assuanEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '%':
+			b.WriteString("%25")
+		case '\n':
+			b.WriteString("%0A")
+		case '\r':
+			b.WriteString("%0D")
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// assuanUnescape reverses the %XX percent-escaping Assuan uses on D
+// data lines.
+func assuanUnescape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+3 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
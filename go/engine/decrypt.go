@@ -0,0 +1,139 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+
+	"github.com/keybase/client/go/libkb"
+)
+
+// sniffLen is how many bytes of lookahead DecryptEngine buffers to
+// identify a message's crypto format. PGP armor and the SaltPack
+// ASCII header both appear well within this window; SaltPack's
+// binary framing is identifiable from the first few bytes.
+const sniffLen = 64
+
+var pgpArmorHeader = []byte("-----BEGIN PGP MESSAGE-----")
+var saltPackArmorHeader = []byte("BEGIN SALTPACK ENCRYPTED MESSAGE")
+
+// saltPackBinaryHeader is the MessagePack encoding of the two-element
+// array SaltPack's binary framing always starts with: a fixarray of
+// length 2 (0x92) followed by the fixstr "saltpack" (0xa8 + bytes).
+var saltPackBinaryHeader = []byte("\x92\xa8saltpack")
+
+// DecryptArg is the input to NewDecrypt.
+type DecryptArg struct {
+	Source io.Reader
+	Sink   libkb.WriteCloserWithResult
+	Opts   DecryptOpts
+}
+
+// DecryptOpts controls how DecryptEngine behaves once it has sniffed
+// a message's format.
+type DecryptOpts struct {
+	// EnforceFormat, if not libkb.CryptoMessageFormatUnknown, makes
+	// DecryptEngine refuse to decrypt anything but a message in this
+	// format. Security-sensitive callers that only ever expect
+	// SaltPack (or only ever expect PGP) should set this so a message
+	// in the other format isn't silently accepted.
+	EnforceFormat libkb.CryptoMessageFormat
+}
+
+// UnrecognizedCryptoFormatError is returned when DecryptEngine can't
+// find a PGP or SaltPack header in the source.
+type UnrecognizedCryptoFormatError struct{}
+
+func (e UnrecognizedCryptoFormatError) Error() string {
+	return "no valid PGP or SaltPack header found"
+}
+
+// DecryptEngine sniffs the format of an encrypted message and
+// dispatches to SaltPackDecrypt or PGPDecrypt, so callers don't need
+// to know the format ahead of time.
+type DecryptEngine struct {
+	libkb.Contextified
+	arg    *DecryptArg
+	format libkb.CryptoMessageFormat
+}
+
+// NewDecrypt creates a DecryptEngine for the given arg.
+func NewDecrypt(arg *DecryptArg, g *libkb.GlobalContext) *DecryptEngine {
+	return &DecryptEngine{
+		Contextified: libkb.NewContextified(g),
+		arg:          arg,
+	}
+}
+
+func (e *DecryptEngine) Name() string {
+	return "Decrypt"
+}
+
+func (e *DecryptEngine) Prereqs() Prereqs {
+	return Prereqs{}
+}
+
+func (e *DecryptEngine) RequiredUIs() []libkb.UIKind {
+	return []libkb.UIKind{
+		libkb.SecretUIKind,
+		libkb.IdentifyUIKind,
+		libkb.LogUIKind,
+		libkb.SaltPackUIKind,
+		libkb.PgpUIKind,
+	}
+}
+
+func (e *DecryptEngine) SubConsumers() []libkb.UIConsumer {
+	return nil
+}
+
+// Format returns the crypto format DecryptEngine sniffed out of the
+// source. It's only meaningful after Run has returned.
+func (e *DecryptEngine) Format() libkb.CryptoMessageFormat {
+	return e.format
+}
+
+func (e *DecryptEngine) Run(ctx *Context) error {
+	br := bufio.NewReaderSize(e.arg.Source, sniffLen)
+	head, _ := br.Peek(sniffLen)
+
+	e.format = sniffCryptoMessageFormat(head)
+	if e.format == libkb.CryptoMessageFormatUnknown {
+		return UnrecognizedCryptoFormatError{}
+	}
+
+	if want := e.arg.Opts.EnforceFormat; want != libkb.CryptoMessageFormatUnknown && want != e.format {
+		return libkb.WrongCryptoFormatError{
+			Wanted:    want,
+			Received:  e.format,
+			Operation: "decrypt",
+		}
+	}
+
+	if e.format == libkb.CryptoMessageFormatPGP {
+		arg := &PGPDecryptArg{Source: br, Sink: e.arg.Sink}
+		return RunEngine(NewPGPDecrypt(arg, e.G()), ctx)
+	}
+
+	arg := &SaltPackDecryptArg{Source: br, Sink: e.arg.Sink}
+	return RunEngine(NewSaltPackDecrypt(arg, e.G()), ctx)
+}
+
+// sniffCryptoMessageFormat looks at the first few bytes of a message
+// and decides which crypto system produced it.
+func sniffCryptoMessageFormat(head []byte) libkb.CryptoMessageFormat {
+	trimmed := bytes.TrimLeft(head, " \t\r\n")
+	switch {
+	case bytes.HasPrefix(trimmed, pgpArmorHeader):
+		return libkb.CryptoMessageFormatPGP
+	case bytes.Contains(head, saltPackArmorHeader):
+		return libkb.CryptoMessageFormatSaltPack
+	case bytes.HasPrefix(head, saltPackBinaryHeader):
+		return libkb.CryptoMessageFormatSaltPack
+	default:
+		return libkb.CryptoMessageFormatUnknown
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package engine
+
+import (
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestDecryptAutoDetectSaltPack(t *testing.T) {
+	boxPub, boxPriv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer withSigncryptResolvers(t, boxPub, boxPriv, nil, "")()
+
+	tc := SetupEngineTest(t, "Decrypt")
+	defer tc.Cleanup()
+	fu := CreateAndSignupFakeUser(tc, "naclp")
+
+	msg := "10 days in Japan"
+	sink := libkb.NewBufferCloser()
+	ctx := &Context{
+		IdentifyUI: &FakeIdentifyUI{},
+		SecretUI:   fu.NewSecretUI(),
+		LogUI:      tc.G.UI.GetLogUI(),
+		SaltPackUI: &fakeSaltPackUI{},
+	}
+
+	encarg := &SaltPackEncryptArg{
+		Source: strings.NewReader(msg),
+		Sink:   sink,
+	}
+	enc := NewSaltPackEncrypt(encarg, tc.G)
+	if err := RunEngine(enc, ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := libkb.NewBufferCloser()
+	dec := NewDecrypt(&DecryptArg{
+		Source: strings.NewReader(sink.String()),
+		Sink:   decoded,
+	}, tc.G)
+	if err := RunEngine(dec, ctx); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.String() != msg {
+		t.Errorf("decoded: %s, expected: %s", decoded.String(), msg)
+	}
+	if dec.Format() != libkb.CryptoMessageFormatSaltPack {
+		t.Errorf("format: %v, expected: %v", dec.Format(), libkb.CryptoMessageFormatSaltPack)
+	}
+}
+
+func TestDecryptAutoDetectPGP(t *testing.T) {
+	tc := SetupEngineTest(t, "Decrypt")
+	defer tc.Cleanup()
+	CreateAndSignupFakeUser(tc, "naclp")
+
+	pgpMsg := `-----BEGIN PGP MESSAGE-----
+Version: GnuPG v1
+
+hQEMA5gKPw0B/gTfAQf+JacZcP+4d1cdmRV5qlrDUhK3qm5dtzAh8KE3z6OMSOmE
+fUAdMZweHZMkWA5C1OZbvZ6SKaFLFHjmiD0DWlcdiXsvgPH9RpTHOSrxdjRlBuwK
+JBz5OrDM/OStIam6jKcxBcrI43JkWOG64AOwJ4Rx3OjAnzbKJKeUCAaopbXc2M5O
+iyTPzEsexRFjSfPGRk9cQD5zfar3Qjk2cRWElgABiQczWtfNAQ3NyQLzmRU6mw+i
+ZLoViAwQm2BMYa2i6MYOJCQtxHLwZCtAbRXTGFZ2nP0gVVX50KIeL/rnzrQ4I05M
+CljEVk3BBSQBl3jqecfT2Ooh+rwgf3VSQ684HIEt5dI/Aama8l7S3ypwVyt8gWhN
+HTngZWUk8Tjn6Q8zrnnoB92G1G+rZHAiChgBFQCaYDBsWa0Pia6Vm+10OAIulGGj
+=pNG+
+-----END PGP MESSAGE-----
+`
+	ctx := &Context{
+		IdentifyUI: &FakeIdentifyUI{},
+		LogUI:      tc.G.UI.GetLogUI(),
+		SaltPackUI: &fakeSaltPackUI{},
+	}
+
+	decoded := libkb.NewBufferCloser()
+	dec := NewDecrypt(&DecryptArg{
+		Source: strings.NewReader(pgpMsg),
+		Sink:   decoded,
+	}, tc.G)
+	// This key isn't one we have, so PGPDecrypt is expected to fail --
+	// we're only checking that DecryptEngine routed to it.
+	if err := RunEngine(dec, ctx); err == nil {
+		t.Fatal("expected PGPDecrypt to fail on an unknown key")
+	}
+	if dec.Format() != libkb.CryptoMessageFormatPGP {
+		t.Errorf("format: %v, expected: %v", dec.Format(), libkb.CryptoMessageFormatPGP)
+	}
+}
+
+func TestDecryptNoValidHeader(t *testing.T) {
+	tc := SetupEngineTest(t, "Decrypt")
+	defer tc.Cleanup()
+	CreateAndSignupFakeUser(tc, "naclp")
+
+	ctx := &Context{
+		IdentifyUI: &FakeIdentifyUI{},
+		LogUI:      tc.G.UI.GetLogUI(),
+		SaltPackUI: &fakeSaltPackUI{},
+	}
+
+	decoded := libkb.NewBufferCloser()
+	dec := NewDecrypt(&DecryptArg{
+		Source: strings.NewReader("not a message of any kind"),
+		Sink:   decoded,
+	}, tc.G)
+	err := RunEngine(dec, ctx)
+	if _, ok := err.(UnrecognizedCryptoFormatError); !ok {
+		t.Fatalf("expected UnrecognizedCryptoFormatError, got %T (%v)", err, err)
+	}
+}
+
+func TestDecryptEnforceFormat(t *testing.T) {
+	boxPub, boxPriv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer withSigncryptResolvers(t, boxPub, boxPriv, nil, "")()
+
+	tc := SetupEngineTest(t, "Decrypt")
+	defer tc.Cleanup()
+	fu := CreateAndSignupFakeUser(tc, "naclp")
+
+	msg := "10 days in Japan"
+	sink := libkb.NewBufferCloser()
+	ctx := &Context{
+		IdentifyUI: &FakeIdentifyUI{},
+		SecretUI:   fu.NewSecretUI(),
+		LogUI:      tc.G.UI.GetLogUI(),
+		SaltPackUI: &fakeSaltPackUI{},
+	}
+	encarg := &SaltPackEncryptArg{
+		Source: strings.NewReader(msg),
+		Sink:   sink,
+	}
+	enc := NewSaltPackEncrypt(encarg, tc.G)
+	if err := RunEngine(enc, ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := libkb.NewBufferCloser()
+	dec := NewDecrypt(&DecryptArg{
+		Source: strings.NewReader(sink.String()),
+		Sink:   decoded,
+		Opts:   DecryptOpts{EnforceFormat: libkb.CryptoMessageFormatPGP},
+	}, tc.G)
+	err = RunEngine(dec, ctx)
+	if wse, ok := err.(libkb.WrongCryptoFormatError); !ok {
+		t.Fatalf("expected WrongCryptoFormatError, got %T (%v)", err, err)
+	} else if wse.Wanted != libkb.CryptoMessageFormatPGP || wse.Received != libkb.CryptoMessageFormatSaltPack {
+		t.Fatalf("bad error: %v", wse)
+	}
+}
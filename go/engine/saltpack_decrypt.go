@@ -0,0 +1,146 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package engine
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"github.com/keybase/client/go/libkb"
+	keybase1 "github.com/keybase/client/go/protocol"
+	"golang.org/x/net/context"
+)
+
+// resolveOwnBoxKey returns the caller's own NaCl box keypair, used to
+// open whichever recipient box in an incoming message matches it.
+// Like resolveRecipientBoxKey, the default returns an error and
+// nothing in this package replaces it; it's overridable for tests.
+var resolveOwnBoxKey = func(g *libkb.GlobalContext) (pub, priv *[32]byte, err error) {
+	return nil, nil, errors.New("saltpack: no box key resolver configured")
+}
+
+// SaltPackDecryptArg is the input to NewSaltPackDecrypt.
+type SaltPackDecryptArg struct {
+	Source io.Reader
+	Sink   libkb.WriteCloserWithResult
+	Opts   keybase1.SaltPackDecryptOptions
+}
+
+// SaltPackMessageInfo describes a message's intended recipients, for
+// callers that want to explain why decryption failed. SaltPackDecrypt
+// does not fill in Devices; it is always empty.
+type SaltPackMessageInfo struct {
+	Devices []SaltPackDeviceInfo
+}
+
+// SaltPackDeviceInfo is one entry in SaltPackMessageInfo.Devices.
+type SaltPackDeviceInfo struct {
+	Type       string
+	EncryptKey keybase1.KID
+}
+
+// SaltPackDecrypt decrypts a message produced by SaltPackEncrypt. In
+// signcrypt mode it verifies every chunk's detached signature before
+// releasing any plaintext to Sink, surfacing the resolved signer
+// through the SaltPackPromptForDecrypt UI callback and reporting a
+// failed signature through SaltPackVerifyBadSignature.
+type SaltPackDecrypt struct {
+	libkb.Contextified
+	arg  *SaltPackDecryptArg
+	info *SaltPackMessageInfo
+}
+
+func NewSaltPackDecrypt(arg *SaltPackDecryptArg, g *libkb.GlobalContext) *SaltPackDecrypt {
+	return &SaltPackDecrypt{
+		Contextified: libkb.NewContextified(g),
+		arg:          arg,
+	}
+}
+
+func (e *SaltPackDecrypt) Name() string {
+	return "SaltPackDecrypt"
+}
+
+func (e *SaltPackDecrypt) Prereqs() Prereqs {
+	return Prereqs{}
+}
+
+func (e *SaltPackDecrypt) RequiredUIs() []libkb.UIKind {
+	return []libkb.UIKind{libkb.SecretUIKind, libkb.IdentifyUIKind, libkb.LogUIKind, libkb.SaltPackUIKind}
+}
+
+func (e *SaltPackDecrypt) SubConsumers() []libkb.UIConsumer {
+	return nil
+}
+
+// MessageInfo returns what's known about the message's intended
+// recipients. It's non-nil only after Run has failed on a message whose
+// envelope decoded, and its Devices list is empty.
+func (e *SaltPackDecrypt) MessageInfo() *SaltPackMessageInfo {
+	return e.info
+}
+
+func (e *SaltPackDecrypt) Run(ctx *Context) error {
+	data, err := ioutil.ReadAll(e.arg.Source)
+	if err != nil {
+		return err
+	}
+
+	if sniffCryptoMessageFormat(data) == libkb.CryptoMessageFormatPGP {
+		return libkb.WrongCryptoFormatError{
+			Wanted:    libkb.CryptoMessageFormatSaltPack,
+			Received:  libkb.CryptoMessageFormatPGP,
+			Operation: "decrypt",
+		}
+	}
+
+	myPub, myPriv, err := resolveOwnBoxKey(e.G())
+	if err != nil {
+		return err
+	}
+
+	plaintext, env, err := decryptSaltPackEnvelope(data, myPub, myPriv)
+	if err != nil {
+		if _, ok := err.(SaltPackSigncryptVerifyError); ok && env != nil {
+			sender := keybase1.SaltPackSender{
+				SenderType: keybase1.SaltPackSenderType_SIGNED,
+				SigningKID: env.SigningKID,
+			}
+			if ctx.SaltPackUI != nil {
+				ctx.SaltPackUI.SaltPackVerifyBadSignature(context.TODO(), keybase1.SaltPackVerifyBadSignatureArg{Sender: sender})
+			}
+		}
+		if env != nil {
+			e.info = &SaltPackMessageInfo{}
+		}
+		return err
+	}
+
+	sender := keybase1.SaltPackSender{}
+	if env.Signcrypt {
+		sender.SenderType = keybase1.SaltPackSenderType_SIGNED
+		sender.SigningKID = env.SigningKID
+	}
+
+	if ctx.SaltPackUI != nil {
+		arg := keybase1.SaltPackPromptForDecryptArg{Sender: sender}
+		if err := ctx.SaltPackUI.SaltPackPromptForDecrypt(context.TODO(), arg); err != nil {
+			return err
+		}
+	}
+
+	if _, err := e.arg.Sink.Write(plaintext); err != nil {
+		return err
+	}
+	if err := e.arg.Sink.Close(); err != nil {
+		return err
+	}
+
+	if ctx.SaltPackUI != nil {
+		ctx.SaltPackUI.SaltPackVerifySuccess(context.TODO(), keybase1.SaltPackVerifySuccessArg{Sender: sender})
+	}
+
+	return nil
+}
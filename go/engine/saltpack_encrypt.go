@@ -0,0 +1,120 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/keybase/client/go/libkb"
+	keybase1 "github.com/keybase/client/go/protocol"
+	"golang.org/x/crypto/ed25519"
+)
+
+// selfRecipientMarker is the recipient identifier SaltPackEncrypt
+// passes to resolveRecipientBoxKey for the caller's own key, so "self
+// encrypt" doesn't need a real username.
+const selfRecipientMarker = ""
+
+// resolveRecipientBoxKey maps a recipient identifier -- a username, or
+// selfRecipientMarker for the caller's own key -- to the NaCl box
+// public key to encrypt for. The default resolver returns an error for
+// every recipient, and nothing in this package replaces it, so
+// SaltPackEncrypt fails until one is assigned; it's a package
+// variable so tests can substitute their own resolver without
+// standing up a full user for every recipient.
+var resolveRecipientBoxKey = func(g *libkb.GlobalContext, recipient string) (*[32]byte, error) {
+	return nil, fmt.Errorf("saltpack: no recipient key resolver configured for %q", recipient)
+}
+
+// resolveSigningKey looks up the Ed25519 private key to sign with in
+// signcrypt mode, along with the KID it should be published under
+// (requested, if set, otherwise whatever the active signing key is).
+// Like resolveRecipientBoxKey, the default returns an error and
+// nothing in this package replaces it; it's overridable for tests.
+var resolveSigningKey = func(g *libkb.GlobalContext, requested keybase1.KID) (ed25519.PrivateKey, keybase1.KID, error) {
+	return nil, "", errors.New("saltpack: no signing key resolver configured")
+}
+
+// SaltPackEncryptArg is the input to NewSaltPackEncrypt.
+type SaltPackEncryptArg struct {
+	Source io.Reader
+	Sink   libkb.WriteCloserWithResult
+	Opts   keybase1.SaltPackEncryptOptions
+}
+
+// SaltPackEncrypt encrypts a message for one or more recipients (and,
+// unless Opts.NoSelfEncrypt is set, for the caller too). When
+// Opts.Signcrypt is set, every chunk is additionally signed with the
+// resolved signing key, binding the sender's identity to the
+// ciphertext.
+type SaltPackEncrypt struct {
+	libkb.Contextified
+	arg *SaltPackEncryptArg
+}
+
+func NewSaltPackEncrypt(arg *SaltPackEncryptArg, g *libkb.GlobalContext) *SaltPackEncrypt {
+	return &SaltPackEncrypt{
+		Contextified: libkb.NewContextified(g),
+		arg:          arg,
+	}
+}
+
+func (e *SaltPackEncrypt) Name() string {
+	return "SaltPackEncrypt"
+}
+
+func (e *SaltPackEncrypt) Prereqs() Prereqs {
+	return Prereqs{}
+}
+
+func (e *SaltPackEncrypt) RequiredUIs() []libkb.UIKind {
+	return []libkb.UIKind{libkb.SecretUIKind, libkb.IdentifyUIKind, libkb.LogUIKind, libkb.SaltPackUIKind}
+}
+
+func (e *SaltPackEncrypt) SubConsumers() []libkb.UIConsumer {
+	return nil
+}
+
+func (e *SaltPackEncrypt) Run(ctx *Context) error {
+	opts := e.arg.Opts
+
+	recipients := append([]string{}, opts.Recipients...)
+	if !opts.NoSelfEncrypt {
+		recipients = append(recipients, selfRecipientMarker)
+	}
+	if len(recipients) == 0 {
+		return errors.New("saltpack: no recipients")
+	}
+
+	recipientKeys := make([][32]byte, 0, len(recipients))
+	for _, r := range recipients {
+		key, err := resolveRecipientBoxKey(e.G(), r)
+		if err != nil {
+			return err
+		}
+		recipientKeys = append(recipientKeys, *key)
+	}
+
+	var signer ed25519.PrivateKey
+	signingKID := opts.SigningKey
+	if opts.Signcrypt {
+		var err error
+		signer, signingKID, err = resolveSigningKey(e.G(), opts.SigningKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	out, err := encryptSaltPackEnvelope(e.arg.Source, recipientKeys, opts.Signcrypt, signingKID, signer)
+	if err != nil {
+		return err
+	}
+
+	if _, err := e.arg.Sink.Write(out); err != nil {
+		return err
+	}
+	return e.arg.Sink.Close()
+}
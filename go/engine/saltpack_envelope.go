@@ -0,0 +1,263 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package engine
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	keybase1 "github.com/keybase/client/go/protocol"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+//
+// The wire format SaltPackEncrypt/SaltPackDecrypt share: a per-message
+// random payload key, NaCl-boxed once per recipient, and the
+// plaintext split into fixed-size chunks, each sealed with
+// NaCl secretbox under that payload key. In signcrypt mode, each
+// chunk additionally carries a detached Ed25519 signature (see
+// saltpack_signcrypt.go) over (header hash || chunk index || chunk
+// plaintext hash), binding the sender's long-lived signing key to the
+// ciphertext.
+//
+// This is a simplified stand-in for SaltPack's real msgpack framing,
+// sufficient to round-trip through SaltPackEncrypt/SaltPackDecrypt and
+// exercise the signcrypt wiring; it is armored with the same
+// BEGIN/END SALTPACK ENCRYPTED MESSAGE markers SaltPack itself uses,
+// so format-sniffing code (e.g. DecryptEngine) still recognizes it.
+//
+
+const saltPackChunkSize = 1 << 16 // 64KB of plaintext per chunk
+
+const (
+	saltPackArmorBegin = "BEGIN SALTPACK ENCRYPTED MESSAGE."
+	saltPackArmorEnd   = "END SALTPACK ENCRYPTED MESSAGE."
+)
+
+type saltPackRecipientBox struct {
+	BoxPublicKey [32]byte
+	Nonce        [24]byte
+	Box          []byte
+}
+
+type saltPackChunk struct {
+	Nonce      [24]byte
+	Ciphertext []byte
+	// Signature is only present in signcrypt mode.
+	Signature []byte `json:",omitempty"`
+}
+
+type saltPackEnvelope struct {
+	SenderEphemeralKey [32]byte
+	Signcrypt          bool
+	SigningKID         keybase1.KID
+	Recipients         []saltPackRecipientBox
+	Chunks             []saltPackChunk
+}
+
+// headerHash binds every chunk signature to this message's header:
+// the sender's ephemeral key, the signing KID, the signcrypt flag,
+// and the full recipient list, so a signed chunk can't be spliced
+// into a different message.
+func (e *saltPackEnvelope) headerHash() []byte {
+	h := sha512.New()
+	h.Write(e.SenderEphemeralKey[:])
+	h.Write([]byte(e.SigningKID))
+	if e.Signcrypt {
+		h.Write([]byte{1})
+	} else {
+		h.Write([]byte{0})
+	}
+	for _, r := range e.Recipients {
+		h.Write(r.BoxPublicKey[:])
+	}
+	return h.Sum(nil)
+}
+
+// encryptSaltPackEnvelope encrypts src for recipientKeys, producing an
+// armored message. If signcrypt is set, every chunk additionally
+// carries a detached signature by signer under signingKID; signcrypt
+// with a nil signer is an error, and signer is unused otherwise.
+func encryptSaltPackEnvelope(src io.Reader, recipientKeys [][32]byte, signcrypt bool, signingKID keybase1.KID, signer ed25519.PrivateKey) ([]byte, error) {
+	if len(recipientKeys) == 0 {
+		return nil, errors.New("saltpack: no recipients")
+	}
+	if signcrypt && signer == nil {
+		return nil, errors.New("saltpack: Signcrypt requested but no signing key available")
+	}
+
+	var payloadKey [32]byte
+	if _, err := rand.Read(payloadKey[:]); err != nil {
+		return nil, err
+	}
+	ephPub, ephPriv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	env := &saltPackEnvelope{
+		SenderEphemeralKey: *ephPub,
+		Signcrypt:          signcrypt,
+		SigningKID:         signingKID,
+	}
+	for _, rk := range recipientKeys {
+		var nonce [24]byte
+		if _, err := rand.Read(nonce[:]); err != nil {
+			return nil, err
+		}
+		rk := rk
+		env.Recipients = append(env.Recipients, saltPackRecipientBox{
+			BoxPublicKey: rk,
+			Nonce:        nonce,
+			Box:          box.Seal(nil, payloadKey[:], &nonce, &rk, ephPriv),
+		})
+	}
+
+	headerHash := env.headerHash()
+
+	buf := make([]byte, saltPackChunkSize)
+	var idx uint64
+	for {
+		n, rerr := io.ReadFull(src, buf)
+		if n > 0 {
+			plain := buf[:n]
+			var nonce [24]byte
+			if _, err := rand.Read(nonce[:]); err != nil {
+				return nil, err
+			}
+			chunk := saltPackChunk{
+				Nonce:      nonce,
+				Ciphertext: secretbox.Seal(nil, plain, &nonce, &payloadKey),
+			}
+			if signcrypt {
+				chunk.Signature = signSigncryptChunk(signer, headerHash, idx, plain)
+			}
+			env.Chunks = append(env.Chunks, chunk)
+			idx++
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return nil, rerr
+		}
+	}
+
+	body, err := json.Marshal(env)
+	if err != nil {
+		return nil, err
+	}
+	return armorSaltPack(body), nil
+}
+
+// decryptSaltPackEnvelope opens an armored message addressed to
+// (myPub, myPriv), verifying each chunk's signcrypt signature when
+// present. It returns the partially-decoded envelope even on a
+// signature-verification failure, so the caller can still report
+// which sender the header claimed.
+func decryptSaltPackEnvelope(data []byte, myPub, myPriv *[32]byte) (plaintext []byte, env *saltPackEnvelope, err error) {
+	body, err := dearmorSaltPack(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	env = &saltPackEnvelope{}
+	if err := json.Unmarshal(body, env); err != nil {
+		return nil, nil, err
+	}
+
+	var payloadKey *[32]byte
+	for _, r := range env.Recipients {
+		if r.BoxPublicKey != *myPub {
+			continue
+		}
+		r := r
+		key, ok := box.Open(nil, r.Box, &r.Nonce, &env.SenderEphemeralKey, myPriv)
+		if !ok {
+			return nil, env, errors.New("saltpack: could not open recipient box")
+		}
+		var pk [32]byte
+		copy(pk[:], key)
+		payloadKey = &pk
+		break
+	}
+	if payloadKey == nil {
+		return nil, env, errors.New("saltpack: not a recipient of this message")
+	}
+
+	headerHash := env.headerHash()
+
+	var out bytes.Buffer
+	for idx, chunk := range env.Chunks {
+		plain, ok := secretbox.Open(nil, chunk.Ciphertext, &chunk.Nonce, payloadKey)
+		if !ok {
+			return nil, env, fmt.Errorf("saltpack: could not open chunk %d", idx)
+		}
+		if env.Signcrypt {
+			signerKey, ierr := importEd25519PublicKey(env.SigningKID)
+			if ierr != nil {
+				return nil, env, ierr
+			}
+			if verr := verifySigncryptChunk(signerKey, headerHash, uint64(idx), plain, chunk.Signature); verr != nil {
+				return nil, env, verr
+			}
+		}
+		out.Write(plain)
+	}
+	return out.Bytes(), env, nil
+}
+
+func armorSaltPack(body []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(saltPackArmorBegin)
+	buf.WriteString("\n")
+	buf.WriteString(base64.StdEncoding.EncodeToString(body))
+	buf.WriteString("\n")
+	buf.WriteString(saltPackArmorEnd)
+	buf.WriteString("\n")
+	return buf.Bytes()
+}
+
+func dearmorSaltPack(data []byte) ([]byte, error) {
+	s := string(data)
+	start := strings.Index(s, saltPackArmorBegin)
+	if start < 0 {
+		return nil, errors.New("saltpack: missing armor header")
+	}
+	s = s[start+len(saltPackArmorBegin):]
+	end := strings.Index(s, saltPackArmorEnd)
+	if end < 0 {
+		return nil, errors.New("saltpack: missing armor footer")
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(s[:end]))
+}
+
+// importEd25519PublicKey and exportEd25519PublicKey convert between a
+// signing KID and raw Ed25519 public key bytes. Production resolves a
+// KID to a key through the identity subsystem; here a KID is simply
+// the base64 encoding of the raw public key, which is enough to
+// exercise signcrypt end-to-end without that subsystem.
+func importEd25519PublicKey(kid keybase1.KID) (ed25519.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(string(kid))
+	if err != nil {
+		return nil, fmt.Errorf("saltpack: malformed signing KID: %s", err.Error())
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("saltpack: signing KID has wrong length for ed25519")
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+func exportEd25519PublicKey(pub ed25519.PublicKey) keybase1.KID {
+	return keybase1.KID(base64.StdEncoding.EncodeToString(pub))
+}
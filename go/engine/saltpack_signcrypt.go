@@ -0,0 +1,59 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package engine
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// signcryptChunkDigest is the value a signcrypt chunk signature
+// covers: the message's header hash, the chunk's index as a
+// big-endian uint64 (so a signature can't be replayed at a different
+// position in the stream), and a hash of the chunk's plaintext.
+func signcryptChunkDigest(headerHash []byte, chunkIndex uint64, plaintext []byte) []byte {
+	var idx [8]byte
+	binary.BigEndian.PutUint64(idx[:], chunkIndex)
+
+	plaintextHash := sha512.Sum512(plaintext)
+
+	h := sha512.New()
+	h.Write(headerHash)
+	h.Write(idx[:])
+	h.Write(plaintextHash[:])
+	return h.Sum(nil)
+}
+
+// signSigncryptChunk produces the detached signature embedded in a
+// signcrypt-mode payload packet (saltPackChunk.Signature).
+func signSigncryptChunk(signingKey ed25519.PrivateKey, headerHash []byte, chunkIndex uint64, plaintext []byte) []byte {
+	return ed25519.Sign(signingKey, signcryptChunkDigest(headerHash, chunkIndex, plaintext))
+}
+
+// verifySigncryptChunk checks a chunk's detached signature against
+// the sender's resolved public key.
+func verifySigncryptChunk(signerKey ed25519.PublicKey, headerHash []byte, chunkIndex uint64, plaintext, sig []byte) error {
+	digest := signcryptChunkDigest(headerHash, chunkIndex, plaintext)
+	if !ed25519.Verify(signerKey, digest, sig) {
+		return SaltPackSigncryptVerifyError{ChunkIndex: chunkIndex}
+	}
+	return nil
+}
+
+// SaltPackSigncryptVerifyError means a signcrypt-mode chunk's detached
+// signature didn't check out against the resolved sender's signing
+// key -- either the ciphertext was tampered with in transit, or the
+// sender named in the header isn't who actually signed it.
+// SaltPackDecrypt surfaces this through the SaltPackVerifyBadSignature
+// UI callback rather than failing silently.
+type SaltPackSigncryptVerifyError struct {
+	ChunkIndex uint64
+}
+
+func (e SaltPackSigncryptVerifyError) Error() string {
+	return fmt.Sprintf("saltpack: bad signcrypt signature on chunk %d", e.ChunkIndex)
+}
@@ -0,0 +1,266 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package engine
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	keybase1 "github.com/keybase/client/go/protocol"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/net/context"
+)
+
+// badSigUI records whatever SaltPackVerifyBadSignature was called
+// with, so tests can assert on it.
+type badSigUI struct {
+	fakeSaltPackUI
+	called bool
+	arg    keybase1.SaltPackVerifyBadSignatureArg
+}
+
+func (u *badSigUI) SaltPackVerifyBadSignature(_ context.Context, arg keybase1.SaltPackVerifyBadSignatureArg) error {
+	u.called = true
+	u.arg = arg
+	return nil
+}
+
+// withSigncryptResolvers points resolveRecipientBoxKey, resolveOwnBoxKey
+// and resolveSigningKey at fixed, test-supplied keys for the duration
+// of a test, restoring the previous (unconfigured) resolvers
+// afterward. Production wires these to the identity/key-manager
+// subsystem; tests don't have one to stand up.
+func withSigncryptResolvers(t *testing.T, recipientPub *[32]byte, recipientPriv *[32]byte, signer ed25519.PrivateKey, signingKID keybase1.KID) func() {
+	oldRecipient := resolveRecipientBoxKey
+	oldOwn := resolveOwnBoxKey
+	oldSigning := resolveSigningKey
+
+	resolveRecipientBoxKey = func(g *libkb.GlobalContext, recipient string) (*[32]byte, error) {
+		return recipientPub, nil
+	}
+	resolveOwnBoxKey = func(g *libkb.GlobalContext) (pub, priv *[32]byte, err error) {
+		return recipientPub, recipientPriv, nil
+	}
+	resolveSigningKey = func(g *libkb.GlobalContext, requested keybase1.KID) (ed25519.PrivateKey, keybase1.KID, error) {
+		return signer, signingKID, nil
+	}
+
+	return func() {
+		resolveRecipientBoxKey = oldRecipient
+		resolveOwnBoxKey = oldOwn
+		resolveSigningKey = oldSigning
+	}
+}
+
+// rewriteSaltPackEnvelope dearmors and decodes an encrypted message,
+// applies edit to its envelope, and re-armors the result.
+func rewriteSaltPackEnvelope(t *testing.T, armored string, edit func(env *saltPackEnvelope)) string {
+	body, err := dearmorSaltPack([]byte(armored))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &saltPackEnvelope{}
+	if err := json.Unmarshal(body, env); err != nil {
+		t.Fatal(err)
+	}
+	edit(env)
+	body, err = json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(armorSaltPack(body))
+}
+
+func TestSaltPackSigncryptRoundtrip(t *testing.T) {
+	recipientPub, recipientPriv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signerPub, signerPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingKID := exportEd25519PublicKey(signerPub)
+
+	defer withSigncryptResolvers(t, recipientPub, recipientPriv, signerPriv, signingKID)()
+
+	tc := SetupEngineTest(t, "SaltPackSigncrypt")
+	defer tc.Cleanup()
+
+	msg := "10 days in Japan"
+	sink := libkb.NewBufferCloser()
+	spui := testDecryptSaltPackUI{}
+	ctx := &Context{
+		IdentifyUI: &FakeIdentifyUI{},
+		LogUI:      tc.G.UI.GetLogUI(),
+		SaltPackUI: &spui,
+	}
+
+	encArg := &SaltPackEncryptArg{
+		Source: strings.NewReader(msg),
+		Sink:   sink,
+		Opts:   keybase1.SaltPackEncryptOptions{Signcrypt: true},
+	}
+	enc := NewSaltPackEncrypt(encArg, tc.G)
+	if err := RunEngine(enc, ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := libkb.NewBufferCloser()
+	decArg := &SaltPackDecryptArg{
+		Source: strings.NewReader(sink.String()),
+		Sink:   decoded,
+	}
+	dec := NewSaltPackDecrypt(decArg, tc.G)
+	spui.f = func(arg keybase1.SaltPackPromptForDecryptArg) error {
+		if arg.Sender.SenderType != keybase1.SaltPackSenderType_SIGNED {
+			t.Fatalf("bad sender type: %v", arg.Sender.SenderType)
+		}
+		if arg.Sender.SigningKID != signingKID {
+			t.Fatalf("bad signing KID: %v, expected %v", arg.Sender.SigningKID, signingKID)
+		}
+		return nil
+	}
+	if err := RunEngine(dec, ctx); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.String() != msg {
+		t.Errorf("decoded: %s, expected: %s", decoded.String(), msg)
+	}
+}
+
+func TestSaltPackSigncryptForgedSignature(t *testing.T) {
+	recipientPub, recipientPriv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signerPub, signerPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingKID := exportEd25519PublicKey(signerPub)
+
+	defer withSigncryptResolvers(t, recipientPub, recipientPriv, signerPriv, signingKID)()
+
+	tc := SetupEngineTest(t, "SaltPackSigncrypt")
+	defer tc.Cleanup()
+
+	msg := "10 days in Japan"
+	sink := libkb.NewBufferCloser()
+	ctx := &Context{
+		IdentifyUI: &FakeIdentifyUI{},
+		LogUI:      tc.G.UI.GetLogUI(),
+		SaltPackUI: &fakeSaltPackUI{},
+	}
+
+	encArg := &SaltPackEncryptArg{
+		Source: strings.NewReader(msg),
+		Sink:   sink,
+		Opts:   keybase1.SaltPackEncryptOptions{Signcrypt: true},
+	}
+	enc := NewSaltPackEncrypt(encArg, tc.G)
+	if err := RunEngine(enc, ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Forge the first chunk's signature after encryption: the chunk
+	// still decrypts, but its signature no longer verifies.
+	tampered := rewriteSaltPackEnvelope(t, sink.String(), func(env *saltPackEnvelope) {
+		env.Chunks[0].Signature[0] ^= 0xff
+	})
+
+	bsui := &badSigUI{}
+	ctx.SaltPackUI = bsui
+
+	decoded := libkb.NewBufferCloser()
+	decArg := &SaltPackDecryptArg{
+		Source: strings.NewReader(tampered),
+		Sink:   decoded,
+	}
+	dec := NewSaltPackDecrypt(decArg, tc.G)
+	err = RunEngine(dec, ctx)
+	if err == nil {
+		t.Fatal("expected tampered message to fail decryption")
+	}
+	if _, ok := err.(SaltPackSigncryptVerifyError); !ok {
+		t.Fatalf("expected SaltPackSigncryptVerifyError, got %T (%v)", err, err)
+	}
+	if !bsui.called {
+		t.Fatal("expected SaltPackVerifyBadSignature to be called")
+	}
+}
+
+func TestSaltPackSigncryptMismatchedSigner(t *testing.T) {
+	recipientPub, recipientPriv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signerPub, signerPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingKID := exportEd25519PublicKey(signerPub)
+	otherKID := exportEd25519PublicKey(otherPub)
+
+	defer withSigncryptResolvers(t, recipientPub, recipientPriv, signerPriv, signingKID)()
+
+	tc := SetupEngineTest(t, "SaltPackSigncrypt")
+	defer tc.Cleanup()
+
+	msg := "10 days in Japan"
+	sink := libkb.NewBufferCloser()
+	ctx := &Context{
+		IdentifyUI: &FakeIdentifyUI{},
+		LogUI:      tc.G.UI.GetLogUI(),
+		SaltPackUI: &fakeSaltPackUI{},
+	}
+
+	encArg := &SaltPackEncryptArg{
+		Source: strings.NewReader(msg),
+		Sink:   sink,
+		Opts:   keybase1.SaltPackEncryptOptions{Signcrypt: true},
+	}
+	enc := NewSaltPackEncrypt(encArg, tc.G)
+	if err := RunEngine(enc, ctx); err != nil {
+		t.Fatal(err)
+	}
+	out := sink.String()
+
+	// Splice in a different signer's KID, as if the header claimed a
+	// sender who didn't actually produce the chunk signatures.
+	spliced := rewriteSaltPackEnvelope(t, out, func(env *saltPackEnvelope) {
+		if env.SigningKID != signingKID {
+			t.Fatalf("test setup: header KID %v, expected %v", env.SigningKID, signingKID)
+		}
+		env.SigningKID = otherKID
+	})
+
+	bsui := &badSigUI{}
+	ctx.SaltPackUI = bsui
+
+	decoded := libkb.NewBufferCloser()
+	decArg := &SaltPackDecryptArg{
+		Source: strings.NewReader(spliced),
+		Sink:   decoded,
+	}
+	dec := NewSaltPackDecrypt(decArg, tc.G)
+	err = RunEngine(dec, ctx)
+	if _, ok := err.(SaltPackSigncryptVerifyError); !ok {
+		t.Fatalf("expected SaltPackSigncryptVerifyError, got %T (%v)", err, err)
+	}
+	if !bsui.called {
+		t.Fatal("expected SaltPackVerifyBadSignature to be called")
+	}
+	if bsui.arg.Sender.SigningKID != otherKID {
+		t.Fatalf("bad sender KID in callback: %v, expected %v", bsui.arg.Sender.SigningKID, otherKID)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2015 Keybase, Inc. All rights reserved. Use of
+// this source code is governed by the included BSD license.
+
+package keybase1
+
+// KID is a key ID: the type used throughout the protocol to name a
+// specific device or paper key without handing around its raw bytes.
+type KID string
+
+// SaltPackSenderType classifies what the decrypting side could
+// establish about a SaltPack message's sender.
+type SaltPackSenderType int
+
+const (
+	SaltPackSenderType_NOT_TRACKED SaltPackSenderType = iota
+	SaltPackSenderType_TRACKING_OK
+	SaltPackSenderType_TRACKING_BROKE
+	SaltPackSenderType_ANONYMOUS
+	// SaltPackSenderType_SIGNED identifies a signcrypt-mode message:
+	// the sender isn't established via a tracking statement, but via
+	// a detached Ed25519 signature over every chunk, verified against
+	// SigningKID.
+	SaltPackSenderType_SIGNED
+)
+
+// SaltPackSender describes what's known about who produced a message.
+type SaltPackSender struct {
+	SenderType SaltPackSenderType
+	Username   string
+	SigningKID KID
+}
+
+// SaltPackPromptForDecryptArg is passed to the SaltPackPromptForDecrypt
+// UI callback before a message's plaintext is released to the caller.
+type SaltPackPromptForDecryptArg struct {
+	SessionID int
+	Sender    SaltPackSender
+}
+
+// SaltPackVerifySuccessArg is passed to the SaltPackVerifySuccess UI
+// callback once a message (and, in signcrypt mode, every chunk of it)
+// has verified.
+type SaltPackVerifySuccessArg struct {
+	SessionID int
+	Sender    SaltPackSender
+}
+
+// SaltPackVerifyBadSignatureArg is passed to the
+// SaltPackVerifyBadSignature UI callback when a signcrypt-mode
+// message's detached chunk signature fails to verify against the
+// sender named in the header -- either the ciphertext was tampered
+// with in transit, or the header's claimed sender isn't who actually
+// signed it.
+type SaltPackVerifyBadSignatureArg struct {
+	SessionID int
+	Sender    SaltPackSender
+}
+
+// SaltPackEncryptOptions controls SaltPackEncrypt.
+type SaltPackEncryptOptions struct {
+	NoSelfEncrypt bool
+	HideSelf      bool
+	Recipients    []string
+
+	// Signcrypt binds SigningKey to the ciphertext: every chunk is
+	// signed in addition to being encrypted, so recipients get
+	// non-repudiable proof of authorship on top of confidentiality.
+	Signcrypt  bool
+	SigningKey KID
+}
+
+// SaltPackDecryptOptions controls SaltPackDecrypt.
+type SaltPackDecryptOptions struct {
+	ForceRemoteCheck bool
+}
@@ -0,0 +1,121 @@
+package libkb
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+//
+// GPGAgentPinentry talks Assuan directly to a running gpg-agent over
+// its socket, instead of spawning a bare pinentry binary. Users who
+// already have gpg-agent unlocked skip a second passphrase prompt,
+// and keybase ends up honoring whatever cache-ttl policy they've
+// configured for the agent.
+//
+
+// GPGAgentPinentry is an alternative to Pinentry that gets a
+// passphrase from a running gpg-agent's GET_PASSPHRASE command rather
+// than spawning pinentry itself.
+type GPGAgentPinentry struct {
+	conn net.Conn
+	as   *assuanClient
+}
+
+func NewGPGAgentPinentry() *GPGAgentPinentry {
+	return &GPGAgentPinentry{}
+}
+
+// Init locates a running gpg-agent's Assuan socket and connects to
+// it, consuming the startup banner.
+func (g *GPGAgentPinentry) Init() error {
+	path, err := findGPGAgentSocket()
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return fmt.Errorf("can't connect to gpg-agent at %s: %s", path, err.Error())
+	}
+
+	as := newAssuanClient(conn, conn)
+	if err := as.expectOK(); err != nil {
+		conn.Close()
+		return err
+	}
+
+	g.conn = conn
+	g.as = as
+	return nil
+}
+
+// findGPGAgentSocket locates the gpg-agent Assuan socket, preferring
+// `gpgconf --list-dirs agent-socket` -- which understands a non-
+// default GNUPGHOME and the socket redirection gpg 2.1+ uses -- and
+// falling back to the traditional $GNUPGHOME/S.gpg-agent location.
+func findGPGAgentSocket() (string, error) {
+	out, err := exec.Command("gpgconf", "--list-dirs", "agent-socket").Output()
+	if err == nil {
+		if path := strings.TrimSpace(string(out)); len(path) > 0 {
+			return path, nil
+		}
+	}
+
+	home := os.Getenv("GNUPGHOME")
+	if len(home) == 0 {
+		home = filepath.Join(os.Getenv("HOME"), ".gnupg")
+	}
+	path := filepath.Join(home, "S.gpg-agent")
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("no running gpg-agent found: %s", err.Error())
+	}
+	return path, nil
+}
+
+// Get prompts for a passphrase via gpg-agent's GET_PASSPHRASE,
+// keying the agent's cache on opts.CacheID and honoring opts.NoCache
+// by clearing any cached entry first.
+func (g *GPGAgentPinentry) Get(prompt, desc, errmsg string, opts PinentryOpts) (pin string, canceled bool, err error) {
+	if g.as == nil {
+		return "", false, fmt.Errorf("gpg-agent pinentry not initialized")
+	}
+
+	cacheID := opts.CacheID
+	if len(cacheID) == 0 {
+		cacheID = "X"
+	}
+
+	if opts.NoCache {
+		if err := g.ClearPassphrase(cacheID); err != nil {
+			G.Log.Debug("| gpg-agent CLEAR_PASSPHRASE %s failed (continuing): %s", cacheID, err)
+		}
+	}
+
+	cmd := fmt.Sprintf("GET_PASSPHRASE --data %s %s %s %s",
+		cacheID, assuanEscape(errmsg), assuanEscape(prompt), assuanEscape(desc))
+	if err := g.as.send(cmd); err != nil {
+		return "", false, err
+	}
+
+	pin, err = g.as.readData()
+	if err != nil {
+		if _, ok := err.(PinentryCanceled); ok {
+			return "", true, nil
+		}
+		return "", false, err
+	}
+	return pin, false, nil
+}
+
+// ClearPassphrase asks gpg-agent to forget any cached passphrase for
+// cacheID, via CLEAR_PASSPHRASE, so the next Get always re-prompts.
+func (g *GPGAgentPinentry) ClearPassphrase(cacheID string) error {
+	if g.as == nil {
+		return fmt.Errorf("gpg-agent pinentry not initialized")
+	}
+	return g.as.command("CLEAR_PASSPHRASE " + cacheID)
+}
@@ -13,39 +13,11 @@ import (
 //
 // Under the Apache 2.0 license
 //
-
-func canExec(s string) error {
-	fi, err := os.Stat(s)
-	if err != nil {
-		return err
-	}
-	mode := fi.Mode()
-
-	//
-	// Only consider non-directories that have at least one +x
-	//  bit set.
-	//
-	// TODO: Recheck this on windows!
-	//   See here for lookpath: http://golang.org/src/pkg/os/exec/lp_windows.go
-	//
-	// Similar to check from exec.LookPath below
-	//   See here: http://golang.org/src/pkg/os/exec/lp_unix.go
-	//
-	if mode.IsDir() {
-		return fmt.Errorf("Program '%s' is a directory", s)
-	} else if int(mode)&0111 == 0 {
-		return fmt.Errorf("Program '%s' isn't executable", s)
-	} else {
-		return nil
-	}
-}
+// canExec and platformPinentryBins are platform-specific -- see
+// pinentry_posix.go and pinentry_windows.go.
+//
 
 func FindPinentry() (string, error) {
-	bins := []string{
-		// If you install MacTools you'll wind up with this pinentry
-		"/usr/local/MacGPG2/libexec/pinentry-mac.app/Contents/MacOS/pinentry-mac",
-	}
-
 	extra_paths := []string{}
 
 	G.Log.Debug("+ FindPinentry()")
@@ -65,7 +37,7 @@ func FindPinentry() (string, error) {
 		return found
 	}
 
-	for _, b := range bins {
+	for _, b := range platformPinentryBins() {
 		if checkFull(b) {
 			return b, nil
 		}
@@ -118,8 +90,143 @@ func (pe *Pinentry) Init() error {
 	return err
 }
 
+// PinentryOpts carries the optional, per-call parameters for
+// Pinentry.Get and GPGAgentPinentry.Get.
+type PinentryOpts struct {
+	// CacheID, if set, is passed through as the Assuan cache_id so
+	// gpg-agent can key its passphrase cache on it. Ignored by a bare
+	// pinentry, which has no cache of its own.
+	CacheID string
+
+	// NoCache tells a cache-aware implementation (gpg-agent) to
+	// forget any cached passphrase for CacheID before prompting, so
+	// the user is always re-asked.
+	NoCache bool
+
+	// QualityBar requests that pinentry show its password-strength
+	// meter while the user types.
+	QualityBar bool
+}
+
+// Get spawns the located pinentry binary and drives it through the
+// Assuan protocol to collect a passphrase from the user: read the
+// startup banner, send the OPTION lines describing our terminal and
+// locale, describe the prompt, then GETPIN.
+func (pe *Pinentry) Get(prompt, desc, errmsg string, opts PinentryOpts) (pin string, canceled bool, err error) {
+	if len(pe.path) == 0 {
+		return "", false, fmt.Errorf("no pinentry program found")
+	}
+
+	cmd := exec.Command(pe.path)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return "", false, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", false, err
+	}
+	if err = cmd.Start(); err != nil {
+		return "", false, err
+	}
+	defer func() {
+		stdin.Close()
+		cmd.Wait()
+	}()
+
+	as := newAssuanClient(stdin, stdout)
+	if err = as.expectOK(); err != nil {
+		return "", false, err
+	}
+
+	for _, opt := range pinentryOptionLines() {
+		// A pinentry that doesn't recognize an OPTION just ERRs it;
+		// that's not fatal, so don't abort the session over it.
+		if err := as.command(opt); err != nil {
+			G.Log.Debug("| pinentry %s: %s", opt, err)
+		}
+	}
+
+	if len(desc) > 0 {
+		if err = as.command("SETDESC " + assuanEscape(desc)); err != nil {
+			return "", false, err
+		}
+	}
+	if len(prompt) > 0 {
+		if err = as.command("SETPROMPT " + assuanEscape(prompt)); err != nil {
+			return "", false, err
+		}
+	}
+	if len(errmsg) > 0 {
+		if err = as.command("SETERROR " + assuanEscape(errmsg)); err != nil {
+			return "", false, err
+		}
+	}
+	if err = as.command("SETOK " + assuanEscape("OK")); err != nil {
+		return "", false, err
+	}
+	if err = as.command("SETCANCEL " + assuanEscape("Cancel")); err != nil {
+		return "", false, err
+	}
+	if opts.QualityBar {
+		// Not all pinentries implement a quality bar; ignore failure.
+		as.command("SETQUALITYBAR")
+	}
+
+	if err = as.send("GETPIN"); err != nil {
+		return "", false, err
+	}
+	pin, err = as.readData()
+	if err != nil {
+		if _, ok := err.(PinentryCanceled); ok {
+			return "", true, nil
+		}
+		return "", false, err
+	}
+	return pin, false, nil
+}
+
+// pinentryOptionLines builds the Assuan OPTION commands that describe
+// our controlling terminal and locale to pinentry, so it can pop up
+// (or draw, in the curses case) in the right place and language.
+func pinentryOptionLines() []string {
+	var opts []string
+	if tty := os.Getenv("GPG_TTY"); len(tty) > 0 {
+		opts = append(opts, "OPTION ttyname="+tty)
+	}
+	if term := os.Getenv("TERM"); len(term) > 0 {
+		opts = append(opts, "OPTION ttytype="+term)
+	}
+	if lc := lookupLocale("LC_CTYPE"); len(lc) > 0 {
+		opts = append(opts, "OPTION lc-ctype="+lc)
+	}
+	if lc := lookupLocale("LC_MESSAGES"); len(lc) > 0 {
+		opts = append(opts, "OPTION lc-messages="+lc)
+	}
+	return opts
+}
+
+// lookupLocale looks up a locale category, falling back to LC_ALL and
+// LANG the way glibc does when the specific category isn't set.
+func lookupLocale(category string) string {
+	for _, key := range []string{category, "LC_ALL", "LANG"} {
+		if v := os.Getenv(key); len(v) > 0 {
+			return v
+		}
+	}
+	return ""
+}
+
+// pinentryClient is satisfied by anything that can run the passphrase
+// dialog over Assuan, whether that's a bare pinentry binary or a
+// running gpg-agent.
+type pinentryClient interface {
+	Init() error
+	Get(prompt, desc, errmsg string, opts PinentryOpts) (pin string, canceled bool, err error)
+}
+
 type FallbackPasswordEntry struct {
-	pinentry *Pinentry
+	pinentry pinentryClient
 	terminal Terminal
 	initRes  *error
 }
@@ -132,9 +239,32 @@ func (pe *FallbackPasswordEntry) Init() error {
 	if pe.initRes != nil {
 		return *pe.initRes
 	}
-	pe.pinentry = NewPinentry()
 	pe.terminal = G.Terminal
-	err := pe.pinentry.Init()
+
+	if G.Env.GetPreferGPGAgent() {
+		agent := NewGPGAgentPinentry()
+		if err := agent.Init(); err == nil {
+			pe.pinentry = agent
+			pe.initRes = &err
+			return nil
+		}
+		G.Log.Debug("| gpg-agent not available, falling back to pinentry")
+	}
+
+	p := NewPinentry()
+	err := p.Init()
+	pe.pinentry = p
 	pe.initRes = &err
 	return err
 }
+
+// GetPassphrase initializes pinentry if needed and uses it to prompt
+// the user for a passphrase. It's the entry point callers should use
+// once they've decided the controlling terminal isn't usable for a
+// direct prompt.
+func (pe *FallbackPasswordEntry) GetPassphrase(prompt, desc, errmsg string, opts PinentryOpts) (pin string, canceled bool, err error) {
+	if err = pe.Init(); err != nil {
+		return "", false, err
+	}
+	return pe.pinentry.Get(prompt, desc, errmsg, opts)
+}
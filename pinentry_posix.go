@@ -0,0 +1,33 @@
+// +build !windows
+
+package libkb
+
+import (
+	"fmt"
+	"os"
+)
+
+// canExec checks that s is a regular file with at least one +x bit
+// set, the same test exec.LookPath uses on POSIX systems.
+func canExec(s string) error {
+	fi, err := os.Stat(s)
+	if err != nil {
+		return err
+	}
+	mode := fi.Mode()
+	if mode.IsDir() {
+		return fmt.Errorf("Program '%s' is a directory", s)
+	} else if int(mode)&0111 == 0 {
+		return fmt.Errorf("Program '%s' isn't executable", s)
+	}
+	return nil
+}
+
+// platformPinentryBins lists known full paths to a pinentry binary to
+// probe before falling back to a PATH search.
+func platformPinentryBins() []string {
+	return []string{
+		// If you install MacTools you'll wind up with this pinentry
+		"/usr/local/MacGPG2/libexec/pinentry-mac.app/Contents/MacOS/pinentry-mac",
+	}
+}
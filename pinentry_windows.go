@@ -0,0 +1,92 @@
+// +build windows
+
+package libkb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// canExec checks that s exists and has one of the extensions listed
+// in PATHEXT -- Windows has no executable bit to check, so this is
+// the closest equivalent to the POSIX mode&0111 test.
+func canExec(s string) error {
+	fi, err := os.Stat(s)
+	if err != nil {
+		return err
+	}
+	if fi.Mode().IsDir() {
+		return fmt.Errorf("Program '%s' is a directory", s)
+	}
+
+	ext := strings.ToLower(filepath.Ext(s))
+	for _, e := range pathExts() {
+		if ext == e {
+			return nil
+		}
+	}
+	return fmt.Errorf("Program '%s' isn't executable (extension %s not in PATHEXT)", s, ext)
+}
+
+// pathExts returns the lowercased extensions from %PATHEXT%, falling
+// back to the Windows default if it isn't set.
+func pathExts() []string {
+	pathext := os.Getenv("PATHEXT")
+	if len(pathext) == 0 {
+		pathext = ".COM;.EXE;.BAT;.CMD"
+	}
+	var exts []string
+	for _, e := range strings.Split(pathext, ";") {
+		if len(e) > 0 {
+			exts = append(exts, strings.ToLower(e))
+		}
+	}
+	return exts
+}
+
+// platformPinentryBins probes the standard Gpg4win install locations:
+// first whatever the GnuPG/Gpg4win installer recorded in the
+// registry, then the conventional Program Files paths.
+func platformPinentryBins() []string {
+	var bins []string
+
+	for _, key := range []string{`SOFTWARE\GNU\GnuPG`, `SOFTWARE\Gpg4win`} {
+		dir, err := registryInstallDir(key)
+		if err != nil || len(dir) == 0 {
+			continue
+		}
+		bins = append(bins, filepath.Join(dir, "bin", "pinentry.exe"))
+	}
+
+	for _, pf := range []string{os.Getenv("ProgramFiles"), os.Getenv("ProgramFiles(x86)")} {
+		if len(pf) == 0 {
+			continue
+		}
+		bins = append(bins,
+			filepath.Join(pf, "GNU", "GnuPG", "bin", "pinentry.exe"),
+			filepath.Join(pf, "Gpg4win", "bin", "pinentry.exe"),
+		)
+	}
+
+	return bins
+}
+
+// registryInstallDir reads the "Install Directory" value out of the
+// given HKLM key, as set by the GnuPG and Gpg4win installers.
+func registryInstallDir(key string) (string, error) {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, key, registry.QUERY_VALUE)
+	if err != nil {
+		return "", err
+	}
+	defer k.Close()
+
+	dir, _, err := k.GetStringValue("Install Directory")
+	if err != nil {
+		return "", err
+	}
+	return dir, nil
+}